@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -115,6 +116,10 @@ type Lock interface {
 	// given. Pools once per LOCK_POLL_INTERVAL (currently 1000)
 	// milliseconds until lockWaitTimeout is passed.
 	ObtainWithin(lockWaitTimeout int64) (ok bool, err error)
+	// Attempts to obtain an exclusive lock, polling once per
+	// LOCK_POOL_INTERVAL until either the lock is obtained or ctx is
+	// done, in which case ctx.Err() is returned.
+	ObtainCtx(ctx context.Context) (ok bool, err error)
 	// Releases exclusive access.
 	Release() error
 	// Returns true if the resource is currently locked. Note that one
@@ -133,27 +138,50 @@ func NewLockImpl(self Lock) *LockImpl {
 	return &LockImpl{self: self}
 }
 
+// ObtainWithin is a convenience wrapper around ObtainCtx: a
+// lockWaitTimeout of LOCK_OBTAIN_WAIT_FOREVER obtains with
+// context.Background(), otherwise a context.WithTimeout is derived
+// from the millisecond timeout.
 func (lock *LockImpl) ObtainWithin(lockWaitTimeout int64) (locked bool, err error) {
+	assert2(lockWaitTimeout >= 0 || lockWaitTimeout == LOCK_OBTAIN_WAIT_FOREVER, fmt.Sprintf(
+		"lockWaitTimeout should be LOCK_OBTAIN_WAIT_FOREVER or a non-negative number (got %v)", lockWaitTimeout))
+
+	ctx := context.Background()
+	if lockWaitTimeout != LOCK_OBTAIN_WAIT_FOREVER {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(lockWaitTimeout)*time.Millisecond)
+		defer cancel()
+	}
+	return lock.ObtainCtx(ctx)
+}
+
+// ObtainCtx polls lock.self.Obtain() once per LOCK_POOL_INTERVAL until
+// either it succeeds, fails with an error, or ctx is done - in which
+// case it returns false and ctx.Err() itself; failureReason is not
+// included in the returned error.
+func (lock *LockImpl) ObtainCtx(ctx context.Context) (locked bool, err error) {
 	lock.failureReason = nil
 	locked, err = lock.self.Obtain()
-	if err != nil {
+	if err != nil || locked {
 		return
 	}
-	assert2(lockWaitTimeout >= 0 || lockWaitTimeout == LOCK_OBTAIN_WAIT_FOREVER, fmt.Sprintf(
-		"lockWaitTimeout should be LOCK_OBTAIN_WAIT_FOREVER or a non-negative number (got %v)", lockWaitTimeout))
 
-	maxSleepCount := lockWaitTimeout / LOCK_POOL_INTERVAL
-	for sleepCount := int64(0); !locked; locked, err = lock.self.Obtain() {
-		if lockWaitTimeout != LOCK_OBTAIN_WAIT_FOREVER && sleepCount >= maxSleepCount {
-			reason := fmt.Sprintf("Lock obtain time out: %v", lock)
+	ticker := time.NewTicker(LOCK_POOL_INTERVAL * time.Millisecond)
+	defer ticker.Stop()
+	for !locked {
+		select {
+		case <-ctx.Done():
+			reason := fmt.Sprintf("Lock obtain cancelled: %v", lock)
 			if lock.failureReason != nil {
 				reason = fmt.Sprintf("%v: %v", reason, lock.failureReason)
 			}
-			err = errors.New(reason)
-			return
+			return false, ctx.Err()
+		case <-ticker.C:
+			locked, err = lock.self.Obtain()
+			if err != nil {
+				return
+			}
 		}
-		sleepCount++
-		time.Sleep(LOCK_POOL_INTERVAL * time.Millisecond)
 	}
 	return
 }
@@ -256,6 +284,62 @@ type Directory interface {
 	EnsureOpen()
 }
 
+/*
+ContextDirectory is implemented by a Directory that can propagate a
+context.Context down to the underlying storage for CreateOutput, Sync
+and OpenInput, instead of running them to completion unconditionally.
+It's deliberately not part of Directory itself: requiring these three
+methods there would mean every existing Directory implementation has
+to grow them before it type-checks again. A decorator that wraps an
+arbitrary Directory (EncryptedDirectory, StatsDirectory) type-asserts
+its delegate against ContextDirectory via createOutputCtx/syncCtx/
+openInputCtx below, and falls back to the plain, non-cancellable
+methods for delegates that don't implement it.
+*/
+type ContextDirectory interface {
+	// CreateOutputCtx is like Directory.CreateOutput but fails fast
+	// with ctx.Err() if ctx is done before the underlying storage is
+	// reached.
+	CreateOutputCtx(ctx context.Context, name string, ioctx IOContext) (out IndexOutput, err error)
+	// SyncCtx is like Directory.Sync but fails fast with ctx.Err() if
+	// ctx is done before the sync completes.
+	SyncCtx(ctx context.Context, names []string) error
+	// OpenInputCtx is like Directory.OpenInput but propagates ctx down
+	// to the returned IndexInput, so a long-running or remote read can
+	// be interrupted.
+	OpenInputCtx(ctx context.Context, name string, ioctx IOContext) (in IndexInput, err error)
+}
+
+func createOutputCtx(d Directory, ctx context.Context, name string, ioctx IOContext) (IndexOutput, error) {
+	if cd, ok := d.(ContextDirectory); ok {
+		return cd.CreateOutputCtx(ctx, name, ioctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.CreateOutput(name, ioctx)
+}
+
+func syncCtx(d Directory, ctx context.Context, names []string) error {
+	if cd, ok := d.(ContextDirectory); ok {
+		return cd.SyncCtx(ctx, names)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Sync(names)
+}
+
+func openInputCtx(d Directory, ctx context.Context, name string, ioctx IOContext) (IndexInput, error) {
+	if cd, ok := d.(ContextDirectory); ok {
+		return cd.OpenInputCtx(ctx, name, ioctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.OpenInput(name, ioctx)
+}
+
 type directoryService interface {
 	OpenInput(name string, context IOContext) (in IndexInput, err error)
 }
@@ -264,10 +348,25 @@ type DirectoryImpl struct {
 	directoryService
 	IsOpen      bool
 	lockFactory LockFactory
+	nameLocks   *NameLockManager
 }
 
 func NewDirectoryImpl(self directoryService) *DirectoryImpl {
-	return &DirectoryImpl{directoryService: self, IsOpen: true}
+	return &DirectoryImpl{directoryService: self, IsOpen: true, nameLocks: NewNameLockManager()}
+}
+
+// WithNameLock runs fn while holding the shared (exclusive=false) or
+// exclusive (exclusive=true) in-process handle for name, so concurrent
+// merges, flushes and readers serialize correctly on that one file.
+// DirectoryImpl only exposes the helper - Go's method resolution can't
+// inject locking transparently through embedding once a concrete type
+// defines its own OpenInput/CreateOutput/DeleteFile/Sync, so each one
+// has to wrap its own method bodies with this before delegating to the
+// underlying storage. EncryptedDirectory is currently the only
+// Directory in this package that does so; any other Directory added
+// here that shares files with concurrent writers should do the same.
+func (d *DirectoryImpl) WithNameLock(name string, exclusive bool, fn func() error) error {
+	return d.nameLocks.WithNameLock(name, exclusive, fn)
 }
 
 func (d *DirectoryImpl) MakeLock(name string) Lock {
@@ -305,8 +404,21 @@ This ID should be the same if two Directory instances
 (even in different JVMs and/or on different machines)
 are considered "the same index".  This is how locking
 "scopes" to the right index.
+
+When lockFactory is an *FSLockFactory, this is the filesystem UUID of
+the mount hosting its lock directory joined with the relative path to
+that directory (or, where no UUID can be found, a hash of the
+directory's absolute path), so two processes opening the same on-disk
+index agree on the LockID even across restarts. Otherwise it falls
+back to fmt's %v of d, i.e. String(), which describes only the lock
+factory and is not derived from the on-disk index.
 */
 func (d *DirectoryImpl) LockID() string {
+	if fs, ok := d.lockFactory.(*FSLockFactory); ok && fs.getLockDir() != "" {
+		if id, err := fsLockID(fs.getLockDir()); err == nil {
+			return id
+		}
+	}
 	return fmt.Sprintf("%v", d)
 }
 
@@ -359,14 +471,23 @@ type SlicedIndexInput struct {
 	base       IndexInput
 	fileOffset int64
 	length     int64
+	ctx        context.Context
 }
 
 func newSlicedIndexInput(desc string, base IndexInput, fileOffset, length int64) *SlicedIndexInput {
 	return newSlicedIndexInputBySize(desc, base, fileOffset, length, BUFFER_SIZE)
 }
 
+func newSlicedIndexInputCtx(ctx context.Context, desc string, base IndexInput, fileOffset, length int64) *SlicedIndexInput {
+	return newSlicedIndexInputBySizeCtx(ctx, desc, base, fileOffset, length, BUFFER_SIZE)
+}
+
 func newSlicedIndexInputBySize(desc string, base IndexInput, fileOffset, length int64, bufferSize int) *SlicedIndexInput {
-	ans := &SlicedIndexInput{base: base, fileOffset: fileOffset, length: length}
+	return newSlicedIndexInputBySizeCtx(context.Background(), desc, base, fileOffset, length, bufferSize)
+}
+
+func newSlicedIndexInputBySizeCtx(ctx context.Context, desc string, base IndexInput, fileOffset, length int64, bufferSize int) *SlicedIndexInput {
+	ans := &SlicedIndexInput{base: base, fileOffset: fileOffset, length: length, ctx: ctx}
 	super := newBufferedIndexInputBySize(fmt.Sprintf(
 		"SlicedIndexInput(%v in %v slice=%v:%v)", desc, base, fileOffset, fileOffset+length), bufferSize)
 	super.SeekReader = ans
@@ -376,6 +497,17 @@ func newSlicedIndexInputBySize(desc string, base IndexInput, fileOffset, length
 }
 
 func (in *SlicedIndexInput) readInternal(buf []byte) (err error) {
+	// Checked every time BufferedIndexInput's buffer is empty and it
+	// calls down here to refill it, so a cancelled search stops pulling
+	// further blocks from a slow or remote delegate instead of reading
+	// to EOF regardless. This is as deep as cancellation can be wired
+	// from this package: BufferedIndexInput itself already serves
+	// already-buffered bytes straight out of its buffer without
+	// calling back down here, so a read that never needs a refill
+	// won't observe ctx being done until its next one does.
+	if err = in.ctx.Err(); err != nil {
+		return err
+	}
 	start := in.FilePointer()
 	if start+int64(len(buf)) > in.length {
 		return errors.New(fmt.Sprintf("read past EOF: %v", in))
@@ -406,5 +538,6 @@ func (in *SlicedIndexInput) Clone() (ans IndexInput) {
 		in.base.Clone(),
 		in.fileOffset,
 		in.length,
+		in.ctx,
 	}
 }
@@ -0,0 +1,523 @@
+package store
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// store/EncryptedDirectory.go
+//
+// EncryptedDirectory wraps an arbitrary Directory and transparently
+// encrypts the content of every file written/read through it, so the
+// wrapped Directory (local disk, NFS, a blob store, ...) never sees
+// plaintext. The on-disk layout follows gocryptfs' per-file scheme: a
+// small file header carrying a version byte and a random file ID,
+// followed by a sequence of fixed-size ciphertext blocks, each
+// independently authenticated with AES-GCM.
+
+const (
+	encVersion         byte = 1
+	encFileIDSize           = 16
+	encHeaderSize           = 1 + encFileIDSize
+	encBlockPlainSize       = 4096
+	encGCMNonceSize         = 16
+	encGCMTagSize           = 16
+	encBlockCipherSize      = encBlockPlainSize + encGCMNonceSize + encGCMTagSize
+)
+
+/*
+KeyProvider supplies the per-file key used to encrypt/decrypt a file
+stored through an EncryptedDirectory. Implementations are free to hold
+the master key in memory (HKDFKeyProvider) or reach out to a KMS /
+OS keyring, as long as FileKey() is deterministic for a given fileID.
+*/
+type KeyProvider interface {
+	// FileKey derives the AES-256 key for the file identified by
+	// fileID, which is always encFileIDSize bytes long.
+	FileKey(fileID []byte) ([]byte, error)
+}
+
+/*
+HKDFKeyProvider is the default KeyProvider: every per-file key is
+derived from a single 32-byte master key via HKDF-SHA256, salted with
+the file's random ID. info, if non-empty, is mixed into every
+derivation so keys pulled from the same master key can be namespaced
+across independent EncryptedDirectory instances.
+*/
+type HKDFKeyProvider struct {
+	masterKey []byte
+	info      []byte
+}
+
+func NewHKDFKeyProvider(masterKey []byte, info []byte) *HKDFKeyProvider {
+	assert2(len(masterKey) == 32, "master key must be 32 bytes (AES-256)")
+	return &HKDFKeyProvider{masterKey: masterKey, info: info}
+}
+
+func (p *HKDFKeyProvider) FileKey(fileID []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, p.masterKey, fileID, p.info)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, fmt.Errorf("derive file key: %v", err)
+	}
+	return key, nil
+}
+
+/*
+EncryptedDirectory decorates a Directory so every file passed through
+it is split into fixed-size plaintext blocks, each sealed with AES-GCM
+under a key derived from a random per-file ID. Construct it with
+NewEncryptedDirectoryCheckIntegrity to authenticate every block of a
+file as soon as it's opened, instead of lazily as blocks are read.
+*/
+type EncryptedDirectory struct {
+	*DirectoryImpl
+	delegate       Directory
+	keys           KeyProvider
+	checkIntegrity bool
+}
+
+func NewEncryptedDirectory(delegate Directory, keys KeyProvider) *EncryptedDirectory {
+	return newEncryptedDirectory(delegate, keys, false)
+}
+
+func NewEncryptedDirectoryCheckIntegrity(delegate Directory, keys KeyProvider) *EncryptedDirectory {
+	return newEncryptedDirectory(delegate, keys, true)
+}
+
+func newEncryptedDirectory(delegate Directory, keys KeyProvider, checkIntegrity bool) *EncryptedDirectory {
+	ans := &EncryptedDirectory{delegate: delegate, keys: keys, checkIntegrity: checkIntegrity}
+	ans.DirectoryImpl = NewDirectoryImpl(ans)
+	return ans
+}
+
+func (d *EncryptedDirectory) ListAll() ([]string, error) {
+	return d.delegate.ListAll()
+}
+
+func (d *EncryptedDirectory) FileExists(name string) bool {
+	return d.delegate.FileExists(name)
+}
+
+func (d *EncryptedDirectory) DeleteFile(name string) error {
+	return d.WithNameLock(name, true, func() error {
+		return d.delegate.DeleteFile(name)
+	})
+}
+
+func (d *EncryptedDirectory) FileLength(name string) (n int64, err error) {
+	cipherLen, err := d.delegate.FileLength(name)
+	if err != nil {
+		return 0, err
+	}
+	return cipherToPlainLength(cipherLen)
+}
+
+func (d *EncryptedDirectory) Sync(names []string) error {
+	return d.SyncCtx(context.Background(), names)
+}
+
+func (d *EncryptedDirectory) SyncCtx(ctx context.Context, names []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Lock every name in a stable order so a concurrent Sync over an
+	// overlapping file set can't deadlock against this one.
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	return d.withSortedNameLocks(sorted, func() error {
+		return syncCtx(d.delegate, ctx, names)
+	})
+}
+
+// withSortedNameLocks acquires exclusive handles on names (already
+// sorted) one at a time, releasing all of them once fn returns.
+func (d *EncryptedDirectory) withSortedNameLocks(names []string, fn func() error) error {
+	if len(names) == 0 {
+		return fn()
+	}
+	return d.WithNameLock(names[0], true, func() error {
+		return d.withSortedNameLocks(names[1:], fn)
+	})
+}
+
+func (d *EncryptedDirectory) Close() error {
+	return d.delegate.Close()
+}
+
+func (d *EncryptedDirectory) CreateOutput(name string, ioctx IOContext) (IndexOutput, error) {
+	return d.CreateOutputCtx(context.Background(), name, ioctx)
+}
+
+func (d *EncryptedDirectory) CreateOutputCtx(ctx context.Context, name string, ioctx IOContext) (out IndexOutput, err error) {
+	d.EnsureOpen()
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	err = d.WithNameLock(name, true, func() error {
+		raw, e := createOutputCtx(d.delegate, ctx, name, ioctx)
+		if e != nil {
+			return e
+		}
+		closeOnErr := true
+		defer func() {
+			if closeOnErr {
+				raw.Close()
+			}
+		}()
+		fileID := make([]byte, encFileIDSize)
+		if _, e = rand.Read(fileID); e != nil {
+			return e
+		}
+		key, e := d.keys.FileKey(fileID)
+		if e != nil {
+			return e
+		}
+		aead, e := newBlockGCM(key)
+		if e != nil {
+			return e
+		}
+		if e = raw.WriteByte(encVersion); e != nil {
+			return e
+		}
+		if e = raw.WriteBytes(fileID); e != nil {
+			return e
+		}
+		out = newEncryptedIndexOutput(raw, aead, fileID)
+		closeOnErr = false
+		return nil
+	})
+	return out, err
+}
+
+func (d *EncryptedDirectory) OpenInput(name string, ioctx IOContext) (IndexInput, error) {
+	return d.OpenInputCtx(context.Background(), name, ioctx)
+}
+
+func (d *EncryptedDirectory) OpenInputCtx(ctx context.Context, name string, ioctx IOContext) (in IndexInput, err error) {
+	d.EnsureOpen()
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	err = d.WithNameLock(name, false, func() error {
+		raw, e := openInputCtx(d.delegate, ctx, name, ioctx)
+		if e != nil {
+			return e
+		}
+		in, e = d.openEncryptedInput(ctx, name, raw)
+		return e
+	})
+	return in, err
+}
+
+func (d *EncryptedDirectory) openEncryptedInput(ctx context.Context, name string, raw IndexInput) (IndexInput, error) {
+	closeOnErr := true
+	defer func() {
+		if closeOnErr {
+			raw.Close()
+		}
+	}()
+	header := make([]byte, encHeaderSize)
+	if err := raw.ReadBytes(header); err != nil {
+		return nil, fmt.Errorf("read header of %v: %v", name, err)
+	}
+	if header[0] != encVersion {
+		return nil, fmt.Errorf("%v: unsupported encrypted file version %v", name, header[0])
+	}
+	key, err := d.keys.FileKey(header[1:encHeaderSize])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newBlockGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plainLen, err := cipherToPlainLength(raw.Length())
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	in := newEncryptedIndexInput(ctx, name, raw, aead, plainLen, header[1:encHeaderSize])
+	if d.checkIntegrity {
+		if err := in.verifyAllBlocks(); err != nil {
+			return nil, err
+		}
+	}
+	closeOnErr = false
+	return in, nil
+}
+
+func (d *EncryptedDirectory) CreateSlicer(name string, ioctx IOContext) (IndexInputSlicer, error) {
+	d.EnsureOpen()
+	in, err := d.OpenInput(name, ioctx)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedIndexInputSlicer{base: in.(*encryptedIndexInput)}, nil
+}
+
+func newBlockGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, encGCMNonceSize)
+}
+
+// cipherToPlainLength maps the on-disk size of an encrypted file
+// (header + N full ciphertext blocks + at most one short final block)
+// back to the plaintext size it holds. It errors out on a final block
+// too short to hold even a nonce and tag, which is what a process
+// crashing mid-write leaves behind. A cipherLen no larger than the
+// header maps to 0 without an error.
+func cipherToPlainLength(cipherLen int64) (int64, error) {
+	if cipherLen <= encHeaderSize {
+		return 0, nil
+	}
+	body := cipherLen - encHeaderSize
+	fullBlocks := body / encBlockCipherSize
+	rem := body % encBlockCipherSize
+	plain := fullBlocks * encBlockPlainSize
+	if rem > 0 {
+		if rem < encGCMNonceSize+encGCMTagSize {
+			return 0, fmt.Errorf("encrypted file has a truncated final block (%d bytes)", rem)
+		}
+		plain += rem - (encGCMNonceSize + encGCMTagSize)
+	}
+	return plain, nil
+}
+
+// blockAAD builds the additional authenticated data for blockIndex,
+// binding a block's GCM tag to both the file it belongs to and its
+// position within it - following the gocryptfs model - so blocks
+// can't be silently swapped, reordered, or duplicated by anyone with
+// write access to the underlying (untrusted) delegate without every
+// such tampered block failing authentication on read.
+func blockAAD(fileID []byte, blockIndex int64) []byte {
+	aad := make([]byte, len(fileID)+8)
+	copy(aad, fileID)
+	binary.BigEndian.PutUint64(aad[len(fileID):], uint64(blockIndex))
+	return aad
+}
+
+func blockIndexForOffset(offset int64) (block, within int) {
+	return int(offset / encBlockPlainSize), int(offset % encBlockPlainSize)
+}
+
+func cipherBlockOffset(block int) int64 {
+	return encHeaderSize + int64(block)*encBlockCipherSize
+}
+
+/*
+encryptedIndexOutput buffers plaintext up to encBlockPlainSize, seals
+each full block with a fresh random nonce as soon as it fills, and
+writes [nonce || ciphertext || tag] to the underlying IndexOutput.
+*/
+type encryptedIndexOutput struct {
+	out        IndexOutput
+	gcm        cipher.AEAD
+	fileID     []byte
+	blockIndex int64
+	buf        []byte
+	written    int64
+}
+
+func newEncryptedIndexOutput(out IndexOutput, gcm cipher.AEAD, fileID []byte) *encryptedIndexOutput {
+	return &encryptedIndexOutput{out: out, gcm: gcm, fileID: fileID, buf: make([]byte, 0, encBlockPlainSize)}
+}
+
+func (o *encryptedIndexOutput) WriteByte(b byte) error {
+	return o.WriteBytes([]byte{b})
+}
+
+func (o *encryptedIndexOutput) WriteBytes(b []byte) error {
+	for len(b) > 0 {
+		n := encBlockPlainSize - len(o.buf)
+		if n > len(b) {
+			n = len(b)
+		}
+		o.buf = append(o.buf, b[:n]...)
+		b = b[n:]
+		o.written += int64(n)
+		if len(o.buf) == encBlockPlainSize {
+			if err := o.flushBlock(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (o *encryptedIndexOutput) flushBlock() error {
+	if len(o.buf) == 0 {
+		return nil
+	}
+	nonce := make([]byte, encGCMNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := o.gcm.Seal(nil, nonce, o.buf, blockAAD(o.fileID, o.blockIndex))
+	if err := o.out.WriteBytes(nonce); err != nil {
+		return err
+	}
+	if err := o.out.WriteBytes(sealed); err != nil {
+		return err
+	}
+	o.blockIndex++
+	o.buf = o.buf[:0]
+	return nil
+}
+
+func (o *encryptedIndexOutput) FilePointer() int64 {
+	return o.written
+}
+
+func (o *encryptedIndexOutput) Length() (int64, error) {
+	return o.written, nil
+}
+
+func (o *encryptedIndexOutput) Close() error {
+	if err := o.flushBlock(); err != nil {
+		return err
+	}
+	return o.out.Close()
+}
+
+/*
+encryptedIndexInput translates plaintext offsets into the enclosing
+ciphertext block(s), authenticating and decrypting through the
+underlying IndexInput. The most recently decrypted block is cached so
+sequential reads - by far the common case during merges and search -
+only pay the GCM cost once per block.
+*/
+type encryptedIndexInput struct {
+	*BufferedIndexInput
+	name     string
+	base     IndexInput
+	gcm      cipher.AEAD
+	fileID   []byte
+	plainLen int64
+	ctx      context.Context
+
+	haveCached  bool
+	cachedBlock int
+	cachedPlain []byte
+}
+
+func newEncryptedIndexInput(ctx context.Context, name string, base IndexInput, gcm cipher.AEAD, plainLen int64, fileID []byte) *encryptedIndexInput {
+	ans := &encryptedIndexInput{name: name, base: base, gcm: gcm, fileID: fileID, plainLen: plainLen, ctx: ctx, cachedBlock: -1}
+	super := newBufferedIndexInputBySize(fmt.Sprintf("EncryptedIndexInput(%v)", name), BUFFER_SIZE)
+	super.SeekReader = ans
+	super.LengthCloser = ans
+	ans.BufferedIndexInput = super
+	return ans
+}
+
+func (in *encryptedIndexInput) readInternal(buf []byte) error {
+	pos := in.FilePointer()
+	for len(buf) > 0 {
+		// Checked before every block decrypt, so a cancelled search
+		// stops pulling further blocks from a slow or remote delegate.
+		if err := in.ctx.Err(); err != nil {
+			return err
+		}
+		block, within := blockIndexForOffset(pos)
+		plain, err := in.decryptBlock(block)
+		if err != nil {
+			return err
+		}
+		n := copy(buf, plain[within:])
+		buf = buf[n:]
+		pos += int64(n)
+	}
+	return nil
+}
+
+func (in *encryptedIndexInput) seekInternal(pos int64) error {
+	return nil // readInternal() recomputes the block from FilePointer()
+}
+
+func (in *encryptedIndexInput) decryptBlock(block int) ([]byte, error) {
+	if in.haveCached && in.cachedBlock == block {
+		return in.cachedPlain, nil
+	}
+	plainSize := encBlockPlainSize
+	if last := int64(block+1) * encBlockPlainSize; last > in.plainLen {
+		plainSize = int(in.plainLen - int64(block)*encBlockPlainSize)
+	}
+	raw := make([]byte, plainSize+encGCMNonceSize+encGCMTagSize)
+	if err := in.base.Seek(cipherBlockOffset(block)); err != nil {
+		return nil, err
+	}
+	if err := in.base.ReadBytesBuffered(raw, false); err != nil {
+		return nil, fmt.Errorf("%v: read block %v: %v", in.name, block, err)
+	}
+	plain, err := in.gcm.Open(nil, raw[:encGCMNonceSize], raw[encGCMNonceSize:], blockAAD(in.fileID, int64(block)))
+	if err != nil {
+		return nil, fmt.Errorf("%v: block %v failed authentication: %v", in.name, block, err)
+	}
+	in.haveCached = true
+	in.cachedBlock = block
+	in.cachedPlain = plain
+	return plain, nil
+}
+
+// verifyAllBlocks authenticates every block without returning
+// decrypted content to a caller; used by checkIntegrity on open.
+func (in *encryptedIndexInput) verifyAllBlocks() error {
+	numBlocks := int((in.plainLen + encBlockPlainSize - 1) / encBlockPlainSize)
+	for block := 0; block < numBlocks; block++ {
+		if _, err := in.decryptBlock(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (in *encryptedIndexInput) Close() error {
+	return in.base.Close()
+}
+
+func (in *encryptedIndexInput) Length() int64 {
+	return in.plainLen
+}
+
+func (in *encryptedIndexInput) Clone() IndexInput {
+	return &encryptedIndexInput{
+		BufferedIndexInput: in.BufferedIndexInput.Clone().(*BufferedIndexInput),
+		name:               in.name,
+		base:               in.base.Clone(),
+		gcm:                in.gcm,
+		fileID:             in.fileID,
+		plainLen:           in.plainLen,
+		ctx:                in.ctx,
+		cachedBlock:        -1,
+	}
+}
+
+// encryptedIndexInputSlicer hands out slices over plaintext ranges:
+// since base is already the decrypting IndexInput, SlicedIndexInput's
+// offset/length arithmetic operates on plaintext transparently.
+type encryptedIndexInputSlicer struct {
+	base *encryptedIndexInput
+}
+
+func (s *encryptedIndexInputSlicer) openSlice(desc string, offset, length int64) IndexInput {
+	return newSlicedIndexInputCtx(s.base.ctx, fmt.Sprintf("SlicedIndexInput(%v in %v)", desc, s.base), s.base, offset, length)
+}
+
+func (s *encryptedIndexInputSlicer) openFullSlice() IndexInput {
+	return s.base
+}
+
+func (s *encryptedIndexInputSlicer) Close() error {
+	return s.base.Close()
+}
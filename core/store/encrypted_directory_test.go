@@ -0,0 +1,115 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newTestEncryptedDirectory wires an EncryptedDirectory over a plain,
+// in-memory RAMDirectory so these tests exercise the real encrypt/
+// decrypt path without touching disk.
+func newTestEncryptedDirectory(t *testing.T, checkIntegrity bool) (*EncryptedDirectory, *RAMDirectory) {
+	t.Helper()
+	delegate := NewRAMDirectory()
+	keys := NewHKDFKeyProvider(bytes.Repeat([]byte{0x42}, 32), []byte("encrypted_directory_test"))
+	if checkIntegrity {
+		return NewEncryptedDirectoryCheckIntegrity(delegate, keys), delegate
+	}
+	return NewEncryptedDirectory(delegate, keys), delegate
+}
+
+func TestEncryptedDirectoryRoundTrip(t *testing.T) {
+	dir, delegate := newTestEncryptedDirectory(t, false)
+
+	// Big enough to span several plaintext blocks (encBlockPlainSize
+	// is 4096) plus a short final one.
+	data := bytes.Repeat([]byte("golucene-encrypted-directory-round-trip "), 1000)
+
+	out, err := dir.CreateOutput("segments.gen", IO_CONTEXT_DEFAULT)
+	if err != nil {
+		t.Fatalf("CreateOutput: %v", err)
+	}
+	if err := out.WriteBytes(data); err != nil {
+		t.Fatalf("WriteBytes: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if n, err := dir.FileLength("segments.gen"); err != nil {
+		t.Fatalf("FileLength: %v", err)
+	} else if n != int64(len(data)) {
+		t.Fatalf("FileLength = %d, want %d", n, len(data))
+	}
+
+	in, err := dir.OpenInput("segments.gen", IO_CONTEXT_DEFAULT)
+	if err != nil {
+		t.Fatalf("OpenInput: %v", err)
+	}
+	defer in.Close()
+
+	if in.Length() != int64(len(data)) {
+		t.Fatalf("Length() = %d, want %d", in.Length(), len(data))
+	}
+	got := make([]byte, len(data))
+	if err := in.ReadBytes(got); err != nil {
+		t.Fatalf("ReadBytes: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("round-tripped content does not match what was written")
+	}
+
+	// The whole point of EncryptedDirectory is that the delegate never
+	// sees plaintext - confirm it doesn't.
+	rawLen, err := delegate.FileLength("segments.gen")
+	if err != nil {
+		t.Fatalf("delegate.FileLength: %v", err)
+	}
+	rawIn, err := delegate.OpenInput("segments.gen", IO_CONTEXT_DEFAULT)
+	if err != nil {
+		t.Fatalf("delegate.OpenInput: %v", err)
+	}
+	defer rawIn.Close()
+	raw := make([]byte, rawLen)
+	if err := rawIn.ReadBytes(raw); err != nil {
+		t.Fatalf("delegate ReadBytes: %v", err)
+	}
+	if bytes.Contains(raw, data) {
+		t.Fatalf("plaintext is visible in the underlying delegate's bytes")
+	}
+}
+
+func TestEncryptedDirectoryCheckIntegrityRoundTrip(t *testing.T) {
+	dir, _ := newTestEncryptedDirectory(t, true)
+
+	// Spans multiple full blocks plus a short final one, so
+	// verifyAllBlocks has more than one block to authenticate.
+	data := bytes.Repeat([]byte{0xCD}, encBlockPlainSize*2+123)
+
+	out, err := dir.CreateOutput("_0.cfs", IO_CONTEXT_DEFAULT)
+	if err != nil {
+		t.Fatalf("CreateOutput: %v", err)
+	}
+	if err := out.WriteBytes(data); err != nil {
+		t.Fatalf("WriteBytes: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// NewEncryptedDirectoryCheckIntegrity authenticates every block as
+	// soon as the file is opened, so a clean round-trip must still
+	// open and read back correctly.
+	in, err := dir.OpenInput("_0.cfs", IO_CONTEXT_DEFAULT)
+	if err != nil {
+		t.Fatalf("OpenInput with checkIntegrity: %v", err)
+	}
+	defer in.Close()
+	got := make([]byte, len(data))
+	if err := in.ReadBytes(got); err != nil {
+		t.Fatalf("ReadBytes: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("round-tripped content does not match what was written")
+	}
+}
@@ -0,0 +1,33 @@
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"path/filepath"
+)
+
+// store/FSLockFactory.go (LockID helper)
+//
+// fsLockID returns a stable identifier for lockDir: the UUID of the
+// filesystem hosting it, joined with lockDir's path relative to that
+// filesystem's mount point (e.g.
+// "fa0b6166-3b55-4994-bd3f-92f4e00a1bb0/var/lib/index"). Two
+// FSLockFactory-backed Directory instances opened against the same
+// on-disk lockDir - even across process restarts, or on different
+// machines sharing the mount - compute the same value, which is what
+// lets locking actually "scope" to the right index (see
+// DirectoryImpl.LockID). When no stable UUID can be determined, falls
+// back to a hash of the absolute path.
+func fsLockID(lockDir string) (string, error) {
+	abs, err := filepath.Abs(lockDir)
+	if err != nil {
+		return "", err
+	}
+	if uuid, mountPoint, err := mountUUID(abs); err == nil {
+		if rel, err := filepath.Rel(mountPoint, abs); err == nil {
+			return uuid + "/" + filepath.ToSlash(rel), nil
+		}
+	}
+	sum := sha1.Sum([]byte(abs))
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,52 @@
+//go:build darwin || freebsd || netbsd || openbsd
+
+package store
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// mountUUID resolves the filesystem UUID of the mount hosting path.
+// Neither statfs nor getfsstat exposes the volume UUID directly, so
+// this shells out to diskutil on macOS; other BSDs don't report a
+// stable volume UUID at all, and fsLockID falls back to a path hash.
+func mountUUID(path string) (uuid, mountPoint string, err error) {
+	mountPoint, err = mountPointFor(path)
+	if err != nil {
+		return "", "", err
+	}
+	out, err := exec.Command("diskutil", "info", mountPoint).Output()
+	if err != nil {
+		return "", "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		idx := strings.Index(line, "Volume UUID:")
+		if idx < 0 {
+			continue
+		}
+		if id := strings.TrimSpace(line[idx+len("Volume UUID:"):]); id != "" {
+			return id, mountPoint, nil
+		}
+	}
+	return "", "", errors.New("diskutil reported no Volume UUID for " + mountPoint)
+}
+
+// mountPointFor shells out to df, which wraps getfsstat(2)/statfs(2),
+// to find the mount point hosting path.
+func mountPointFor(path string) (string, error) {
+	out, err := exec.Command("df", "-P", path).Output()
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	if len(lines) < 2 {
+		return "", errors.New("unexpected df output for " + path)
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 6 {
+		return "", errors.New("unexpected df output for " + path)
+	}
+	return fields[len(fields)-1], nil
+}
@@ -0,0 +1,93 @@
+//go:build linux
+
+package store
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mountUUID resolves the filesystem UUID of the mount hosting path by
+// walking /proc/self/mountinfo for the longest matching mount point,
+// then reading the /dev/disk/by-uuid symlinks to find which UUID
+// points at that mount's backing device.
+func mountUUID(path string) (uuid, mountPoint string, err error) {
+	device, mountPoint, err := mountPointFor(path)
+	if err != nil {
+		return "", "", err
+	}
+	uuid, err = uuidForDevice(device)
+	if err != nil {
+		return "", "", err
+	}
+	return uuid, mountPoint, nil
+}
+
+// mountPointFor scans /proc/self/mountinfo for the entry whose mount
+// point is the longest prefix of path, which is the mount that
+// actually hosts it.
+func mountPointFor(path string) (device, mountPoint string, err error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	bestLen := -1
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// mountinfo fields: ... <mountPoint> ... - <fstype> <source> ...
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+2 >= len(fields) || len(fields) <= 4 {
+			continue
+		}
+		mp := fields[4]
+		if (path != mp && !strings.HasPrefix(path, strings.TrimSuffix(mp, "/")+"/")) || len(mp) <= bestLen {
+			continue
+		}
+		bestLen = len(mp)
+		mountPoint = mp
+		device = fields[sep+2]
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	if bestLen < 0 {
+		return "", "", errors.New("mountinfo: no mount found for " + path)
+	}
+	return device, mountPoint, nil
+}
+
+// uuidForDevice finds the /dev/disk/by-uuid entry whose target
+// resolves to the same device node as device.
+func uuidForDevice(device string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		resolved = device
+	}
+	entries, err := os.ReadDir("/dev/disk/by-uuid")
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		link := filepath.Join("/dev/disk/by-uuid", entry.Name())
+		target, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			continue
+		}
+		if target == resolved {
+			return entry.Name(), nil
+		}
+	}
+	return "", errors.New("no UUID found for device " + device)
+}
@@ -0,0 +1,91 @@
+//go:build linux
+
+package store
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// bindMount mounts src at dst for the duration of the test, requiring
+// root. Tests using it skip gracefully when that's not available,
+// since CI/sandbox environments commonly run unprivileged.
+func bindMount(t *testing.T, src, dst string) {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("bind mounts require root")
+	}
+	if err := exec.Command("mount", "--bind", src, dst).Run(); err != nil {
+		t.Skipf("bind mount unavailable in this environment: %v", err)
+	}
+	t.Cleanup(func() {
+		exec.Command("umount", dst).Run()
+	})
+}
+
+// TestMountPointForDoesNotMatchUnrelatedSiblingByPrefix reproduces the
+// case where a mount and an unrelated sibling directory share a
+// string prefix (e.g. a "/data" mount and a plain "/data2/lib/index"
+// directory that lives on a different filesystem entirely):
+// mountPointFor must not attribute the sibling to the unrelated mount
+// just because its path starts with the mount's path.
+func TestMountPointForDoesNotMatchUnrelatedSiblingByPrefix(t *testing.T) {
+	base := t.TempDir()
+	mountDir := filepath.Join(base, "data")
+	siblingDir := filepath.Join(base, "data2", "lib", "index")
+	if err := os.MkdirAll(mountDir, 0755); err != nil {
+		t.Fatalf("MkdirAll(%v): %v", mountDir, err)
+	}
+	if err := os.MkdirAll(siblingDir, 0755); err != nil {
+		t.Fatalf("MkdirAll(%v): %v", siblingDir, err)
+	}
+
+	// Give mountDir its own mountinfo entry distinct from base's, so
+	// a naive prefix match has something to wrongly latch onto.
+	bindMount(t, mountDir, mountDir)
+
+	_, mountPoint, err := mountPointFor(siblingDir)
+	if err != nil {
+		t.Fatalf("mountPointFor(%v): %v", siblingDir, err)
+	}
+	if mountPoint == mountDir {
+		t.Fatalf("siblingDir %v must not be attributed to unrelated mount %v", siblingDir, mountDir)
+	}
+}
+
+// TestFsLockIDAgreesAcrossBindMountsOfTheSameDirectory exercises the
+// guarantee fsLockID exists for: two paths that resolve to the same
+// underlying directory - here, two bind mounts of one source - must
+// compute the same LockID, even though the paths themselves differ.
+func TestFsLockIDAgreesAcrossBindMountsOfTheSameDirectory(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "src")
+	mountA := filepath.Join(base, "mountA")
+	mountB := filepath.Join(base, "mountB")
+	for _, d := range []string{src, mountA, mountB} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("MkdirAll(%v): %v", d, err)
+		}
+	}
+
+	bindMount(t, src, mountA)
+	bindMount(t, src, mountB)
+
+	if _, _, err := mountUUID(mountA); err != nil {
+		t.Skipf("no filesystem UUID resolvable in this environment (%v); the cross-path LockID guarantee depends on one", err)
+	}
+
+	idA, err := fsLockID(mountA)
+	if err != nil {
+		t.Fatalf("fsLockID(%v): %v", mountA, err)
+	}
+	idB, err := fsLockID(mountB)
+	if err != nil {
+		t.Fatalf("fsLockID(%v): %v", mountB, err)
+	}
+	if idA != idB {
+		t.Fatalf("fsLockID mismatch for two mounts of the same directory: %v (%v) != %v (%v)", mountA, idA, mountB, idB)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package store
+
+import "errors"
+
+// mountUUID has no implementation on this platform; fsLockID falls
+// back to hashing the absolute path instead.
+func mountUUID(path string) (uuid, mountPoint string, err error) {
+	return "", "", errors.New("mountUUID: not supported on this platform")
+}
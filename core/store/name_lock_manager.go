@@ -0,0 +1,82 @@
+package store
+
+import "sync"
+
+// store/NameLockManager.go
+//
+// NameLockManager hands out reference-counted sync.RWMutex handles
+// keyed by file name, so goroutines sharing a process coordinate on
+// individual segment files instead of serializing through a single
+// directory-wide lock (which only ever protected against other
+// processes to begin with - see Lock/LockFactory in directory.go). An entry is
+// evicted from the map as soon as its refcount drops back to zero, so
+// the map never grows past the number of files currently in use.
+type NameLockManager struct {
+	mu    sync.Mutex
+	locks map[string]*refCountedLock
+}
+
+func NewNameLockManager() *NameLockManager {
+	return &NameLockManager{locks: make(map[string]*refCountedLock)}
+}
+
+type refCountedLock struct {
+	mu  sync.RWMutex
+	ref int
+}
+
+func (m *NameLockManager) acquire(name string) *refCountedLock {
+	m.mu.Lock()
+	l, ok := m.locks[name]
+	if !ok {
+		l = &refCountedLock{}
+		m.locks[name] = l
+	}
+	l.ref++
+	m.mu.Unlock()
+	return l
+}
+
+func (m *NameLockManager) release(name string, l *refCountedLock) {
+	m.mu.Lock()
+	l.ref--
+	if l.ref == 0 {
+		delete(m.locks, name)
+	}
+	m.mu.Unlock()
+}
+
+// RLock acquires a shared handle on name and returns a closure that
+// must be called exactly once to release it.
+func (m *NameLockManager) RLock(name string) (unlock func()) {
+	l := m.acquire(name)
+	l.mu.RLock()
+	return func() {
+		l.mu.RUnlock()
+		m.release(name, l)
+	}
+}
+
+// Lock acquires an exclusive handle on name and returns a closure that
+// must be called exactly once to release it.
+func (m *NameLockManager) Lock(name string) (unlock func()) {
+	l := m.acquire(name)
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		m.release(name, l)
+	}
+}
+
+// WithNameLock runs fn while holding the shared (exclusive=false) or
+// exclusive (exclusive=true) handle for name.
+func (m *NameLockManager) WithNameLock(name string, exclusive bool, fn func() error) error {
+	var unlock func()
+	if exclusive {
+		unlock = m.Lock(name)
+	} else {
+		unlock = m.RLock(name)
+	}
+	defer unlock()
+	return fn()
+}
@@ -0,0 +1,321 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// store/StatsDirectory.go
+//
+// StatsDirectory decorates a Directory with counters and latency
+// stats for OpenInput, CreateOutput, Sync, DeleteFile, FileLength and
+// ListAll, plus byte counts on ReadBytes/WriteBytes, bucketed by the
+// IOContext's context type (and further split by MergeInfo.IsExternal
+// for merges). Modeled on Arvados' osWithStats. IOContext already
+// carries hints about why a file is being touched; this is what
+// actually observes them, so operators can see how much IO merges vs.
+// flushes vs. search really cost, and tests can assert e.g. that a
+// flush never triggers a read.
+
+const (
+	ctxClassMerge   = "MERGE"
+	ctxClassFlush   = "FLUSH"
+	ctxClassRead    = "READ"
+	ctxClassDefault = "DEFAULT"
+)
+
+// classifyContext maps an IOContext to the bucket label its stats
+// should be recorded under.
+func classifyContext(ctx IOContext) string {
+	switch ctx.context {
+	case IOContextType(IO_CONTEXT_TYPE_MERGE):
+		if ctx.MergeInfo != nil && ctx.MergeInfo.IsExternal {
+			return ctxClassMerge + "-EXTERNAL"
+		}
+		return ctxClassMerge
+	case IOContextType(IO_CONTEXT_TYPE_FLUSH):
+		return ctxClassFlush
+	case IOContextType(IO_CONTEXT_TYPE_READ):
+		return ctxClassRead
+	default:
+		return ctxClassDefault
+	}
+}
+
+// OpStats is a point-in-time snapshot of the counters for one
+// operation (optionally scoped to one IOContext bucket).
+type OpStats struct {
+	Count      int64
+	Errors     int64
+	Bytes      int64
+	TotalNanos int64
+	MaxNanos   int64
+}
+
+// opStats is the mutable, mutex-guarded counterpart of OpStats.
+type opStats struct {
+	count      int64
+	errors     int64
+	bytes      int64
+	totalNanos int64
+	maxNanos   int64
+}
+
+func (s *opStats) observe(elapsed time.Duration, nbytes int64, err error) {
+	s.count++
+	nanos := elapsed.Nanoseconds()
+	s.totalNanos += nanos
+	if nanos > s.maxNanos {
+		s.maxNanos = nanos
+	}
+	s.bytes += nbytes
+	if err != nil {
+		s.errors++
+	}
+}
+
+func (s *opStats) snapshot() OpStats {
+	return OpStats{Count: s.count, Errors: s.errors, Bytes: s.bytes, TotalNanos: s.totalNanos, MaxNanos: s.maxNanos}
+}
+
+// DirectoryStats is a snapshot returned by StatsDirectory.Stats().
+type DirectoryStats struct {
+	OpenInput    map[string]OpStats
+	CreateOutput map[string]OpStats
+	ReadBytes    map[string]OpStats
+	WriteBytes   map[string]OpStats
+	Sync         OpStats
+	DeleteFile   OpStats
+	FileLength   OpStats
+	ListAll      OpStats
+}
+
+type StatsDirectory struct {
+	*DirectoryImpl
+	delegate Directory
+
+	mu           sync.Mutex
+	openInput    map[string]*opStats
+	createOutput map[string]*opStats
+	readBytes    map[string]*opStats
+	writeBytes   map[string]*opStats
+	syncOp       opStats
+	deleteFileOp opStats
+	fileLengthOp opStats
+	listAllOp    opStats
+}
+
+func NewStatsDirectory(delegate Directory) *StatsDirectory {
+	ans := &StatsDirectory{delegate: delegate}
+	ans.resetLocked()
+	ans.DirectoryImpl = NewDirectoryImpl(ans)
+	return ans
+}
+
+func (d *StatsDirectory) resetLocked() {
+	d.openInput = make(map[string]*opStats)
+	d.createOutput = make(map[string]*opStats)
+	d.readBytes = make(map[string]*opStats)
+	d.writeBytes = make(map[string]*opStats)
+	d.syncOp = opStats{}
+	d.deleteFileOp = opStats{}
+	d.fileLengthOp = opStats{}
+	d.listAllOp = opStats{}
+}
+
+// Reset discards every counter collected so far.
+func (d *StatsDirectory) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.resetLocked()
+}
+
+// Stats returns a snapshot of every counter collected so far.
+func (d *StatsDirectory) Stats() DirectoryStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return DirectoryStats{
+		OpenInput:    snapshotBuckets(d.openInput),
+		CreateOutput: snapshotBuckets(d.createOutput),
+		ReadBytes:    snapshotBuckets(d.readBytes),
+		WriteBytes:   snapshotBuckets(d.writeBytes),
+		Sync:         d.syncOp.snapshot(),
+		DeleteFile:   d.deleteFileOp.snapshot(),
+		FileLength:   d.fileLengthOp.snapshot(),
+		ListAll:      d.listAllOp.snapshot(),
+	}
+}
+
+func snapshotBuckets(m map[string]*opStats) map[string]OpStats {
+	ans := make(map[string]OpStats, len(m))
+	for label, s := range m {
+		ans[label] = s.snapshot()
+	}
+	return ans
+}
+
+func (d *StatsDirectory) record(s *opStats, elapsed time.Duration, nbytes int64, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s.observe(elapsed, nbytes, err)
+}
+
+func (d *StatsDirectory) recordBucket(m map[string]*opStats, label string, elapsed time.Duration, nbytes int64, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := m[label]
+	if !ok {
+		s = &opStats{}
+		m[label] = s
+	}
+	s.observe(elapsed, nbytes, err)
+}
+
+func (d *StatsDirectory) ListAll() (paths []string, err error) {
+	start := time.Now()
+	paths, err = d.delegate.ListAll()
+	d.record(&d.listAllOp, time.Since(start), 0, err)
+	return paths, err
+}
+
+func (d *StatsDirectory) FileExists(name string) bool {
+	return d.delegate.FileExists(name)
+}
+
+func (d *StatsDirectory) DeleteFile(name string) error {
+	start := time.Now()
+	err := d.delegate.DeleteFile(name)
+	d.record(&d.deleteFileOp, time.Since(start), 0, err)
+	return err
+}
+
+func (d *StatsDirectory) FileLength(name string) (n int64, err error) {
+	start := time.Now()
+	n, err = d.delegate.FileLength(name)
+	d.record(&d.fileLengthOp, time.Since(start), 0, err)
+	return n, err
+}
+
+func (d *StatsDirectory) Sync(names []string) error {
+	return d.SyncCtx(context.Background(), names)
+}
+
+func (d *StatsDirectory) SyncCtx(ctx context.Context, names []string) error {
+	start := time.Now()
+	err := syncCtx(d.delegate, ctx, names)
+	d.record(&d.syncOp, time.Since(start), 0, err)
+	return err
+}
+
+func (d *StatsDirectory) Close() error {
+	return d.delegate.Close()
+}
+
+func (d *StatsDirectory) CreateOutput(name string, ioctx IOContext) (IndexOutput, error) {
+	return d.CreateOutputCtx(context.Background(), name, ioctx)
+}
+
+func (d *StatsDirectory) CreateOutputCtx(ctx context.Context, name string, ioctx IOContext) (out IndexOutput, err error) {
+	label := classifyContext(ioctx)
+	start := time.Now()
+	raw, err := createOutputCtx(d.delegate, ctx, name, ioctx)
+	d.recordBucket(d.createOutput, label, time.Since(start), 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &statsIndexOutput{IndexOutput: raw, dir: d, label: label}, nil
+}
+
+func (d *StatsDirectory) OpenInput(name string, ioctx IOContext) (IndexInput, error) {
+	return d.OpenInputCtx(context.Background(), name, ioctx)
+}
+
+func (d *StatsDirectory) OpenInputCtx(ctx context.Context, name string, ioctx IOContext) (in IndexInput, err error) {
+	label := classifyContext(ioctx)
+	start := time.Now()
+	raw, err := openInputCtx(d.delegate, ctx, name, ioctx)
+	d.recordBucket(d.openInput, label, time.Since(start), 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &statsIndexInput{IndexInput: raw, dir: d, label: label}, nil
+}
+
+func (d *StatsDirectory) CreateSlicer(name string, ctx IOContext) (IndexInputSlicer, error) {
+	label := classifyContext(ctx)
+	start := time.Now()
+	raw, err := d.delegate.CreateSlicer(name, ctx)
+	d.recordBucket(d.openInput, label, time.Since(start), 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &statsIndexInputSlicer{raw: raw, dir: d, label: label}, nil
+}
+
+// statsIndexInput decorates an IndexInput, recording byte counts and
+// latency for ReadBytes under the bucket the owning OpenInput call was
+// classified into. Every other method (Seek, FilePointer, Length,
+// Close) is promoted straight through to the embedded IndexInput.
+type statsIndexInput struct {
+	IndexInput
+	dir   *StatsDirectory
+	label string
+}
+
+func (in *statsIndexInput) ReadBytes(buf []byte) error {
+	start := time.Now()
+	err := in.IndexInput.ReadBytes(buf)
+	in.dir.recordBucket(in.dir.readBytes, in.label, time.Since(start), int64(len(buf)), err)
+	return err
+}
+
+func (in *statsIndexInput) Clone() IndexInput {
+	return &statsIndexInput{IndexInput: in.IndexInput.Clone(), dir: in.dir, label: in.label}
+}
+
+// statsIndexInputSlicer decorates an IndexInputSlicer so that every
+// IndexInput it hands out - which is how the dominant, per-segment
+// read path during searching actually reaches IndexInput.ReadBytes -
+// is wrapped the same way OpenInput wraps a whole-file IndexInput,
+// instead of exposing raw, unmeasured IO from the delegate.
+type statsIndexInputSlicer struct {
+	raw   IndexInputSlicer
+	dir   *StatsDirectory
+	label string
+}
+
+func (s *statsIndexInputSlicer) openSlice(desc string, offset, length int64) IndexInput {
+	return &statsIndexInput{IndexInput: s.raw.openSlice(desc, offset, length), dir: s.dir, label: s.label}
+}
+
+func (s *statsIndexInputSlicer) openFullSlice() IndexInput {
+	return &statsIndexInput{IndexInput: s.raw.openFullSlice(), dir: s.dir, label: s.label}
+}
+
+func (s *statsIndexInputSlicer) Close() error {
+	return s.raw.Close()
+}
+
+// statsIndexOutput decorates an IndexOutput, recording byte counts and
+// latency for WriteByte/WriteBytes under the bucket the owning
+// CreateOutput call was classified into.
+type statsIndexOutput struct {
+	IndexOutput
+	dir   *StatsDirectory
+	label string
+}
+
+func (out *statsIndexOutput) WriteByte(b byte) error {
+	start := time.Now()
+	err := out.IndexOutput.WriteByte(b)
+	out.dir.recordBucket(out.dir.writeBytes, out.label, time.Since(start), 1, err)
+	return err
+}
+
+func (out *statsIndexOutput) WriteBytes(b []byte) error {
+	start := time.Now()
+	err := out.IndexOutput.WriteBytes(b)
+	out.dir.recordBucket(out.dir.writeBytes, out.label, time.Since(start), int64(len(b)), err)
+	return err
+}
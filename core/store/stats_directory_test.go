@@ -0,0 +1,120 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStatsDirectoryBucketsByIOContext(t *testing.T) {
+	delegate := NewRAMDirectory()
+	dir := NewStatsDirectory(delegate)
+
+	out, err := dir.CreateOutput("_0.fdt", IO_CONTEXT_DEFAULT)
+	if err != nil {
+		t.Fatalf("CreateOutput: %v", err)
+	}
+	if err := out.WriteBytes([]byte("flush-me")); err != nil {
+		t.Fatalf("WriteBytes: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	in, err := dir.OpenInput("_0.fdt", IO_CONTEXT_READ)
+	if err != nil {
+		t.Fatalf("OpenInput: %v", err)
+	}
+	got := make([]byte, len("flush-me"))
+	if err := in.ReadBytes(got); err != nil {
+		t.Fatalf("ReadBytes: %v", err)
+	}
+	if err := in.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !bytes.Equal(got, []byte("flush-me")) {
+		t.Fatalf("round-tripped content does not match what was written")
+	}
+
+	stats := dir.Stats()
+
+	writeBucket, ok := stats.CreateOutput[ctxClassDefault]
+	if !ok {
+		t.Fatalf("CreateOutput stats missing %v bucket: %+v", ctxClassDefault, stats.CreateOutput)
+	}
+	if writeBucket.Count != 1 {
+		t.Fatalf("CreateOutput[%v].Count = %d, want 1", ctxClassDefault, writeBucket.Count)
+	}
+
+	readBucket, ok := stats.OpenInput[ctxClassRead]
+	if !ok {
+		t.Fatalf("OpenInput stats missing %v bucket: %+v", ctxClassRead, stats.OpenInput)
+	}
+	if readBucket.Count != 1 {
+		t.Fatalf("OpenInput[%v].Count = %d, want 1", ctxClassRead, readBucket.Count)
+	}
+
+	// The read happened under IO_CONTEXT_READ, so the DEFAULT bucket
+	// the file was written under must not have accumulated any reads:
+	// reads are attributed to the IOContext they were opened with, not
+	// to the one the file was written with.
+	if n, ok := stats.ReadBytes[ctxClassDefault]; ok && n.Count != 0 {
+		t.Fatalf("ReadBytes recorded %d reads under %v, want 0", n.Count, ctxClassDefault)
+	}
+	readBytesBucket, ok := stats.ReadBytes[ctxClassRead]
+	if !ok || readBytesBucket.Bytes != int64(len("flush-me")) {
+		t.Fatalf("ReadBytes[%v] = %+v, want Bytes=%d", ctxClassRead, readBytesBucket, len("flush-me"))
+	}
+}
+
+func TestStatsDirectoryCreateSlicerDoesNotReopenDelegate(t *testing.T) {
+	delegate := NewRAMDirectory()
+	dir := NewStatsDirectory(delegate)
+
+	out, err := dir.CreateOutput("_0.cfs", IO_CONTEXT_DEFAULT)
+	if err != nil {
+		t.Fatalf("CreateOutput: %v", err)
+	}
+	if err := out.WriteBytes([]byte("sliced-data")); err != nil {
+		t.Fatalf("WriteBytes: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	slicer, err := dir.CreateSlicer("_0.cfs", IO_CONTEXT_READ)
+	if err != nil {
+		t.Fatalf("CreateSlicer: %v", err)
+	}
+	defer slicer.Close()
+
+	stats := dir.Stats()
+	if n, ok := stats.OpenInput[ctxClassRead]; !ok || n.Count != 1 {
+		t.Fatalf("CreateSlicer must record exactly one OpenInput under %v, got %+v", ctxClassRead, stats.OpenInput)
+	}
+}
+
+func TestStatsDirectoryReset(t *testing.T) {
+	dir := NewStatsDirectory(NewRAMDirectory())
+
+	out, err := dir.CreateOutput("_0.si", IO_CONTEXT_DEFAULT)
+	if err != nil {
+		t.Fatalf("CreateOutput: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if stats := dir.Stats(); len(stats.CreateOutput) == 0 {
+		t.Fatalf("expected CreateOutput stats to be populated before Reset")
+	}
+
+	dir.Reset()
+
+	stats := dir.Stats()
+	if len(stats.CreateOutput) != 0 {
+		t.Fatalf("CreateOutput stats not cleared by Reset: %+v", stats.CreateOutput)
+	}
+	if stats.ListAll.Count != 0 {
+		t.Fatalf("ListAll stats not cleared by Reset: %+v", stats.ListAll)
+	}
+}
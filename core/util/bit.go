@@ -1,5 +1,7 @@
 package util
 
+import "math/bits"
+
 // util/BitUtil.java
 
 var BYTE_COUNTS = []int{ // table of bits/byte
@@ -79,14 +81,91 @@ func BitCount(b byte) int {
 func pop_array(arr []int64) int {
 	popCount := 0
 	for _, v := range arr {
-		for v > 0 {
-			popCount += BitCount(byte(v & 0xff))
-			v >>= 8
-		}
+		popCount += bits.OnesCount64(uint64(v))
 	}
 	return popCount
 }
 
+/* Returns the number of set bits in x. */
+func PopCount(x uint64) int {
+	return bits.OnesCount64(x)
+}
+
+/*
+Returns the number of set bits among the bits [start, end) of arr,
+treating arr as one contiguous bit-addressed array of 64-bit words -
+start and end are bit offsets, not word offsets, matching Lucene's
+FixedBitSet.popCount range semantics.
+*/
+func PopCountRange(arr []int64, start, end int) int {
+	if start >= end {
+		return 0
+	}
+	startWord := start / 64
+	endWord := (end - 1) / 64
+	if startWord == endWord {
+		return bits.OnesCount64(uint64(arr[startWord]) & wordMask(start%64, end-startWord*64))
+	}
+	count := bits.OnesCount64(uint64(arr[startWord]) & wordMask(start%64, 64))
+	for i := startWord + 1; i < endWord; i++ {
+		count += bits.OnesCount64(uint64(arr[i]))
+	}
+	count += bits.OnesCount64(uint64(arr[endWord]) & wordMask(0, end-endWord*64))
+	return count
+}
+
+// wordMask returns a mask with bits [from, to) set, where from and to
+// are both in [0, 64].
+func wordMask(from, to int) uint64 {
+	lo := ^uint64(0) << uint(from)
+	if to >= 64 {
+		return lo
+	}
+	return lo &^ (^uint64(0) << uint(to))
+}
+
+/*
+AndCardinality returns the number of set bits in (a AND b), fusing the
+AND with the popcount in one pass without allocating a temporary
+bitset. a and b must be the same length.
+*/
+func AndCardinality(a, b []int64) int {
+	count := 0
+	for i := range a {
+		count += bits.OnesCount64(uint64(a[i]) & uint64(b[i]))
+	}
+	return count
+}
+
+/*
+OrCardinality returns the number of set bits in (a OR b), fusing the OR
+with the popcount in one pass without allocating a temporary bitset. a
+and b must be the same length.
+*/
+func OrCardinality(a, b []int64) int {
+	count := 0
+	for i := range a {
+		count += bits.OnesCount64(uint64(a[i]) | uint64(b[i]))
+	}
+	return count
+}
+
+/*
+NextSetBit returns the index, in [0, 64), of the next set bit in word
+at or after from, or -1 if word has no set bit at or after from. It
+lets an iterator over a sparse bitset advance a word at a time instead
+of consuming one BIT_LISTS lookup per set bit.
+*/
+func NextSetBit(word uint64, from int) int {
+	if from > 0 {
+		word &^= (uint64(1) << uint(from)) - 1
+	}
+	if word == 0 {
+		return -1
+	}
+	return bits.TrailingZeros64(word)
+}
+
 func ZigZagEncodeLong(l int64) int64 {
 	return (l >> 63) ^ (l << 1)
 }